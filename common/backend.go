@@ -0,0 +1,256 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// Output is a single named value exposed by a provisioned stack
+type Output struct {
+	Key   string
+	Value string
+}
+
+// BackendStatus is the backend-neutral status of a stack
+type BackendStatus struct {
+	Name   string
+	Exists bool
+	State  string
+}
+
+// IaCBackend is a backend-neutral interface for provisioning infrastructure, so `mu`'s
+// environment/service/pipeline model isn't locked to CloudFormation. The backend is chosen by
+// the backendType passed to NewIaCBackend; neither mu.yml nor PipelineManager selects it.
+type IaCBackend interface {
+	// Plan previews the changes required to bring stackName to the given template/parameters,
+	// returning an opaque plan ID that Apply can later execute. templateBody is in whichever
+	// format the selected backend natively consumes - a CloudFormation template for
+	// cloudformationBackend, Terraform JSON configuration for terraformBackend (which writes it to
+	// a .tf.json file, so HCL syntax is not accepted).
+	Plan(stackName string, templateBody string, parameters map[string]string) (string, error)
+
+	// Apply executes a previously created plan
+	Apply(stackName string, planID string) error
+
+	// Destroy tears down the stack entirely
+	Destroy(stackName string) error
+
+	// Status returns the current backend-neutral status of the stack
+	Status(stackName string) (*BackendStatus, error)
+
+	// Outputs returns the named values the stack exposes
+	Outputs(stackName string) ([]Output, error)
+}
+
+// NewIaCBackend creates the IaCBackend selected by backendType ("cloudformation" or "terraform").
+// An empty backendType defaults to "cloudformation". The Logger attached to ctx (see NewContext)
+// is used for every operation the backend performs.
+func NewIaCBackend(ctx context.Context, backendType string, region string, workDir string) (IaCBackend, error) {
+	switch backendType {
+	case "", "cloudformation":
+		return newCloudFormationBackend(ctx, region)
+	case "terraform":
+		return newTerraformBackend(ctx, workDir, fmt.Sprintf("mu-terraform-state-%s", region), "mu-terraform-locks")
+	default:
+		return nil, fmt.Errorf("unknown backend type '%s'", backendType)
+	}
+}
+
+// cloudformationBackend adapts cloudformationStackManager to the IaCBackend interface
+type cloudformationBackend struct {
+	cfnMgr *cloudformationStackManager
+}
+
+func newCloudFormationBackend(ctx context.Context, region string) (IaCBackend, error) {
+	stackMgr, err := newStackManager(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudformationBackend{cfnMgr: stackMgr.(*cloudformationStackManager)}, nil
+}
+
+func (backend *cloudformationBackend) Plan(stackName string, templateBody string, parameters map[string]string) (string, error) {
+	plan, err := backend.cfnMgr.PlanStack(stackName, templateBody, parameters)
+	if err != nil {
+		return "", err
+	}
+	return plan.ChangeSetID, nil
+}
+
+func (backend *cloudformationBackend) Apply(stackName string, planID string) error {
+	return backend.cfnMgr.ApplyChangeSet(planID)
+}
+
+func (backend *cloudformationBackend) Destroy(stackName string) error {
+	return backend.cfnMgr.DestroyStack(stackName)
+}
+
+func (backend *cloudformationBackend) Status(stackName string) (*BackendStatus, error) {
+	logger := backend.cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "status"})
+
+	resp, err := backend.cfnMgr.cfnAPI.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Describe stacks complete err=%s", err)
+	if err != nil || resp == nil || len(resp.Stacks) != 1 {
+		return &BackendStatus{Name: stackName, Exists: false}, nil
+	}
+
+	return &BackendStatus{Name: stackName, Exists: true, State: aws.StringValue(resp.Stacks[0].StackStatus)}, nil
+}
+
+func (backend *cloudformationBackend) Outputs(stackName string) ([]Output, error) {
+	logger := backend.cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "outputs"})
+
+	resp, err := backend.cfnMgr.cfnAPI.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Describe stacks complete err=%s", err)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make([]Output, 0)
+	for _, stack := range resp.Stacks {
+		for _, o := range stack.Outputs {
+			outputs = append(outputs, Output{Key: aws.StringValue(o.OutputKey), Value: aws.StringValue(o.OutputValue)})
+		}
+	}
+	return outputs, nil
+}
+
+// terraformBackend shells out to the terraform CLI, storing state in the S3 bucket and DynamoDB
+// lock table that NewIaCBackend names (mu-terraform-state-<region> and mu-terraform-locks). This
+// is not the mu-templates bucket that holds CloudFormation artifacts.
+type terraformBackend struct {
+	workDir     string
+	stateBucket string
+	lockTable   string
+	logger      Logger
+}
+
+func newTerraformBackend(ctx context.Context, workDir string, stateBucket string, lockTable string) (IaCBackend, error) {
+	if _, err := exec.LookPath("terraform"); err != nil {
+		return nil, fmt.Errorf("terraform backend selected but terraform binary not found in PATH: %s", err)
+	}
+	return &terraformBackend{
+		workDir:     workDir,
+		stateBucket: stateBucket,
+		lockTable:   lockTable,
+		logger:      LoggerFromContext(ctx).WithFields(Fields{"operation": "terraform"}),
+	}, nil
+}
+
+// stackDir returns the per-stack root module directory under workDir. Each stack gets its own
+// directory because terraform loads every *.tf.json file in a directory as one configuration -
+// sharing workDir across stacks would mix one stack's resources into another's plan.
+func (backend *terraformBackend) stackDir(stackName string) string {
+	return filepath.Join(backend.workDir, stackName)
+}
+
+func (backend *terraformBackend) run(dir string, args ...string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("terraform", args...)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	backend.logger.Debugf("  Running 'terraform %s' in %s", strings.Join(args, " "), dir)
+	err := cmd.Run()
+	return out.String(), err
+}
+
+func (backend *terraformBackend) init(stackName string) error {
+	backendConfig := fmt.Sprintf("bucket=%s,dynamodb_table=%s,key=%s/terraform.tfstate,encrypt=true",
+		backend.stateBucket, backend.lockTable, stackName)
+	_, err := backend.run(backend.stackDir(stackName), "init", "-input=false", "-backend-config="+backendConfig)
+	return err
+}
+
+// writeTemplate writes templateBody - the Terraform JSON configuration for stackName - into the
+// stack's directory as a .tf.json file, so the plan/apply/destroy below actually provision what
+// the caller asked for rather than whatever configuration happened to already be sitting there.
+func (backend *terraformBackend) writeTemplate(stackName string, templateBody string) error {
+	dir := backend.stackDir(stackName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, stackName+".tf.json"), []byte(templateBody), 0644)
+}
+
+func (backend *terraformBackend) Plan(stackName string, templateBody string, parameters map[string]string) (string, error) {
+	if err := backend.writeTemplate(stackName, templateBody); err != nil {
+		return "", err
+	}
+
+	if err := backend.init(stackName); err != nil {
+		return "", err
+	}
+
+	args := []string{"plan", "-input=false", "-out=" + stackName + ".tfplan"}
+	for key, value := range parameters {
+		args = append(args, fmt.Sprintf("-var=%s=%s", key, value))
+	}
+
+	if _, err := backend.run(backend.stackDir(stackName), args...); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(backend.stackDir(stackName), stackName+".tfplan"), nil
+}
+
+func (backend *terraformBackend) Apply(stackName string, planID string) error {
+	_, err := backend.run(backend.stackDir(stackName), "apply", "-input=false", planID)
+	return err
+}
+
+func (backend *terraformBackend) Destroy(stackName string) error {
+	if err := backend.init(stackName); err != nil {
+		return err
+	}
+	_, err := backend.run(backend.stackDir(stackName), "destroy", "-input=false", "-auto-approve")
+	return err
+}
+
+func (backend *terraformBackend) Status(stackName string) (*BackendStatus, error) {
+	output, err := backend.run(backend.stackDir(stackName), "show", "-json")
+	if err != nil {
+		return nil, err
+	}
+	exists := strings.TrimSpace(output) != "" && strings.TrimSpace(output) != "{}"
+	return &BackendStatus{Name: stackName, Exists: exists, State: output}, nil
+}
+
+func (backend *terraformBackend) Outputs(stackName string) ([]Output, error) {
+	output, err := backend.run(backend.stackDir(stackName), "output", "-json")
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(output), &raw); err != nil {
+		return nil, err
+	}
+
+	outputs := make([]Output, 0, len(raw))
+	for key, value := range raw {
+		outputs = append(outputs, Output{Key: key, Value: string(value.Value)})
+	}
+	return outputs, nil
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// driftPollInterval is how often DetectDrift polls for detection completion
+const driftPollInterval = 5 * time.Second
+
+// ResourceChange describes a single resource-level change within a ChangeSetPlan
+type ResourceChange struct {
+	LogicalID    string
+	PhysicalID   string
+	ResourceType string
+	Action       string
+	Replacement  bool
+}
+
+// ChangeSetPlan is the parsed result of creating a change set for a stack
+type ChangeSetPlan struct {
+	ChangeSetID string
+	StackName   string
+	Changes     []ResourceChange
+}
+
+// DriftedResource describes a stack resource whose actual state has diverged from the template
+type DriftedResource struct {
+	LogicalID                string
+	PhysicalID               string
+	StackResourceDriftStatus string
+	PropertyDifferences      []string
+}
+
+// ChangeSetPlanner for previewing the resource-level impact of a stack update before applying it
+type ChangeSetPlanner interface {
+	PlanStack(stackName string, templateBody string, stackParameters map[string]string) (*ChangeSetPlan, error)
+}
+
+// ChangeSetApplier for executing a previously created change set
+type ChangeSetApplier interface {
+	ApplyChangeSet(changeSetID string) error
+}
+
+// DriftDetector for discovering stacks whose actual resources have diverged from the template
+type DriftDetector interface {
+	DetectDrift(stackName string) ([]DriftedResource, error)
+}
+
+// PlanStack creates a change set for the stack and returns the parsed resource-level changes.
+// templateBody is resolved the same way UpsertStack resolves it - staged in S3 via TemplateURL
+// when it exceeds maxInlineTemplateSize - so planning a large template doesn't fail where
+// applying it would have succeeded.
+func (cfnMgr *cloudformationStackManager) PlanStack(stackName string, templateBody string, stackParameters map[string]string) (*ChangeSetPlan, error) {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "plan"})
+	cfnAPI := cfnMgr.cfnAPI
+
+	resolvedBody, resolvedURL, err := cfnMgr.resolveTemplateSource(stackName, templateBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfnMgr.ValidateTemplate(resolvedBody, resolvedURL); err != nil {
+		return nil, err
+	}
+
+	changeSetType := cloudformation.ChangeSetTypeUpdate
+	if status, _ := cfnMgr.AwaitFinalStatus(stackName, nil); status == "" {
+		changeSetType = cloudformation.ChangeSetTypeCreate
+	}
+
+	changeSetName := fmt.Sprintf("%s-%d", stackName, time.Now().Unix())
+	parameters := buildStackParameters(stackParameters)
+
+	logger.Debugf("  Creating change set named '%s' for stack '%s'", changeSetName, stackName)
+	createOutput, err := cfnAPI.CreateChangeSet(&cloudformation.CreateChangeSetInput{
+		StackName:     aws.String(stackName),
+		ChangeSetName: aws.String(changeSetName),
+		ChangeSetType: aws.String(changeSetType),
+		Capabilities: []*string{
+			aws.String(cloudformation.CapabilityCapabilityIam),
+		},
+		Parameters:   parameters,
+		TemplateBody: resolvedBody,
+		TemplateURL:  resolvedURL,
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Create change set complete err=%s", err)
+	if err != nil {
+		return nil, err
+	}
+
+	describeParams := &cloudformation.DescribeChangeSetInput{
+		ChangeSetName: createOutput.Id,
+		StackName:     aws.String(stackName),
+	}
+
+	logger.Debugf("  Waiting for change set '%s' to complete...", changeSetName)
+	waitErr := cfnAPI.WaitUntilChangeSetCreateComplete(describeParams)
+
+	describeOutput, err := cfnAPI.DescribeChangeSet(describeParams)
+	logger.WithFields(requestIDFields(err)).Debugf("  Describe change set complete err=%s", err)
+	if err != nil {
+		return nil, err
+	}
+
+	if waitErr != nil {
+		if describeOutput.StatusReason != nil && strings.Contains(*describeOutput.StatusReason, "didn't contain changes") {
+			logger.Noticef("  No changes for stack '%s'", stackName)
+			return &ChangeSetPlan{ChangeSetID: aws.StringValue(createOutput.Id), StackName: stackName}, nil
+		}
+		return nil, fmt.Errorf("change set '%s' failed: %s", changeSetName, aws.StringValue(describeOutput.StatusReason))
+	}
+
+	changes := make([]ResourceChange, 0, len(describeOutput.Changes))
+	for _, change := range describeOutput.Changes {
+		rc := change.ResourceChange
+		changes = append(changes, ResourceChange{
+			LogicalID:    aws.StringValue(rc.LogicalResourceId),
+			PhysicalID:   aws.StringValue(rc.PhysicalResourceId),
+			ResourceType: aws.StringValue(rc.ResourceType),
+			Action:       aws.StringValue(rc.Action),
+			Replacement:  aws.StringValue(rc.Replacement) == cloudformation.ReplacementTrue,
+		})
+	}
+
+	return &ChangeSetPlan{
+		ChangeSetID: aws.StringValue(createOutput.Id),
+		StackName:   stackName,
+		Changes:     changes,
+	}, nil
+}
+
+// ApplyChangeSet executes a previously created change set
+func (cfnMgr *cloudformationStackManager) ApplyChangeSet(changeSetID string) error {
+	logger := cfnMgr.logger.WithFields(Fields{"operation": "apply-changeset"})
+	logger.Debugf("  Executing change set '%s'", changeSetID)
+	_, err := cfnMgr.cfnAPI.ExecuteChangeSet(&cloudformation.ExecuteChangeSetInput{
+		ChangeSetName: aws.String(changeSetID),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Execute change set complete err=%s", err)
+	return err
+}
+
+// DetectDrift triggers drift detection for the stack and returns the resources that have drifted
+func (cfnMgr *cloudformationStackManager) DetectDrift(stackName string) ([]DriftedResource, error) {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "detect-drift"})
+	cfnAPI := cfnMgr.cfnAPI
+
+	logger.Debugf("  Detecting drift for stack '%s'", stackName)
+	startOutput, err := cfnAPI.DetectStackDrift(&cloudformation.DetectStackDriftInput{
+		StackName: aws.String(stackName),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Detect stack drift complete err=%s", err)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		statusOutput, err := cfnAPI.DescribeStackDriftDetectionStatus(&cloudformation.DescribeStackDriftDetectionStatusInput{
+			StackDriftDetectionId: startOutput.StackDriftDetectionId,
+		})
+		logger.WithFields(requestIDFields(err)).Debugf("  Describe stack drift detection status complete err=%s", err)
+		if err != nil {
+			return nil, err
+		}
+		if aws.StringValue(statusOutput.DetectionStatus) != cloudformation.StackDriftDetectionStatusDetectionInProgress {
+			break
+		}
+		time.Sleep(driftPollInterval)
+	}
+
+	var drifts []*cloudformation.StackResourceDrift
+	err = cfnAPI.DescribeStackResourceDriftsPages(&cloudformation.DescribeStackResourceDriftsInput{
+		StackName: aws.String(stackName),
+	}, func(page *cloudformation.DescribeStackResourceDriftsOutput, lastPage bool) bool {
+		drifts = append(drifts, page.StackResourceDrifts...)
+		return true
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Describe stack resource drifts complete err=%s", err)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted := make([]DriftedResource, 0, len(drifts))
+	for _, drift := range drifts {
+		driftStatus := aws.StringValue(drift.StackResourceDriftStatus)
+		if driftStatus == cloudformation.StackResourceDriftStatusInSync || driftStatus == cloudformation.StackResourceDriftStatusNotChecked {
+			continue
+		}
+		diffs := make([]string, 0, len(drift.PropertyDifferences))
+		for _, prop := range drift.PropertyDifferences {
+			diffs = append(diffs, fmt.Sprintf("%s: expected=%s actual=%s",
+				aws.StringValue(prop.PropertyPath), aws.StringValue(prop.ExpectedValue), aws.StringValue(prop.ActualValue)))
+		}
+		drifted = append(drifted, DriftedResource{
+			LogicalID:                aws.StringValue(drift.LogicalResourceId),
+			PhysicalID:               aws.StringValue(drift.PhysicalResourceId),
+			StackResourceDriftStatus: aws.StringValue(drift.StackResourceDriftStatus),
+			PropertyDifferences:      diffs,
+		})
+	}
+
+	return drifted, nil
+}
+
+// planAndDump creates a change set for the stack and writes the template and change set to disk
+// instead of applying it, satisfying a "dry-run" request without touching the live stack.
+func (cfnMgr *cloudformationStackManager) planAndDump(stackName string, templateBody string, stackParameters map[string]string) error {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "dry-run"})
+	plan, err := cfnMgr.PlanStack(stackName, templateBody, stackParameters)
+	if err != nil {
+		return err
+	}
+
+	dryRunDir := filepath.Join(os.TempDir(), "mu-dry-run")
+	if err := os.MkdirAll(dryRunDir, 0755); err != nil {
+		return err
+	}
+
+	templatePath := filepath.Join(dryRunDir, fmt.Sprintf("%s.yml", stackName))
+	if err := ioutil.WriteFile(templatePath, []byte(templateBody), 0644); err != nil {
+		return err
+	}
+
+	changeSetJSON, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	changeSetPath := filepath.Join(dryRunDir, fmt.Sprintf("%s.changeset.json", stackName))
+	if err := ioutil.WriteFile(changeSetPath, changeSetJSON, 0644); err != nil {
+		return err
+	}
+
+	logger.Noticef("  Dry run complete for stack '%s': template written to %s, change set written to %s", stackName, templatePath, changeSetPath)
+	return nil
+}
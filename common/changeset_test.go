@@ -0,0 +1,107 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// fakePlanCfnAPI backs a PlanStack test: the stack doesn't exist yet (DescribeStacks errors),
+// and CreateChangeSet records what template source PlanStack resolved to.
+type fakePlanCfnAPI struct {
+	cloudformationiface.CloudFormationAPI
+	createInput *cloudformation.CreateChangeSetInput
+}
+
+func (f *fakePlanCfnAPI) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	return nil, errors.New("stack does not exist")
+}
+
+func (f *fakePlanCfnAPI) ValidateTemplate(input *cloudformation.ValidateTemplateInput) (*cloudformation.ValidateTemplateOutput, error) {
+	return &cloudformation.ValidateTemplateOutput{}, nil
+}
+
+func (f *fakePlanCfnAPI) CreateChangeSet(input *cloudformation.CreateChangeSetInput) (*cloudformation.CreateChangeSetOutput, error) {
+	f.createInput = input
+	return &cloudformation.CreateChangeSetOutput{Id: aws.String("changeset-id")}, nil
+}
+
+func (f *fakePlanCfnAPI) WaitUntilChangeSetCreateComplete(input *cloudformation.DescribeChangeSetInput) error {
+	return nil
+}
+
+func (f *fakePlanCfnAPI) DescribeChangeSet(input *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	return &cloudformation.DescribeChangeSetOutput{Status: aws.String(cloudformation.ChangeSetStatusCreateComplete)}, nil
+}
+
+// fakePlanTemplatePackager stands in for the S3-backed packager, recording the stack name and
+// body PlanStack staged when the template exceeds maxInlineTemplateSize.
+type fakePlanTemplatePackager struct {
+	uploadedStack string
+	uploadedBody  string
+}
+
+func (f *fakePlanTemplatePackager) PackageTemplate(templatePath string) (string, error) {
+	return "", errors.New("not used by this test")
+}
+
+func (f *fakePlanTemplatePackager) UploadTemplateBody(stackName string, templateBody string) (string, error) {
+	f.uploadedStack = stackName
+	f.uploadedBody = templateBody
+	return "https://testbucket.s3.amazonaws.com/" + stackName, nil
+}
+
+func TestPlanStackFallsBackToTemplateURLWhenOverInlineLimit(t *testing.T) {
+	fakeAPI := &fakePlanCfnAPI{}
+	fakePackager := &fakePlanTemplatePackager{}
+	cfnMgr := &cloudformationStackManager{cfnAPI: fakeAPI, templatePackager: fakePackager, logger: NewNopLogger()}
+
+	largeBody := strings.Repeat("a", maxInlineTemplateSize+1)
+
+	plan, err := cfnMgr.PlanStack("my-stack", largeBody, nil)
+	if err != nil {
+		t.Fatalf("PlanStack returned error: %s", err)
+	}
+	if plan.ChangeSetID != "changeset-id" {
+		t.Errorf("expected change set ID 'changeset-id', got '%s'", plan.ChangeSetID)
+	}
+
+	if fakePackager.uploadedStack != "my-stack" || fakePackager.uploadedBody != largeBody {
+		t.Fatalf("expected the oversized template to be staged via UploadTemplateBody, got stack=%q body-len=%d",
+			fakePackager.uploadedStack, len(fakePackager.uploadedBody))
+	}
+
+	if fakeAPI.createInput.TemplateBody != nil {
+		t.Errorf("expected TemplateBody to be unset once the template is staged via URL, got %q", aws.StringValue(fakeAPI.createInput.TemplateBody))
+	}
+	expectedURL := "https://testbucket.s3.amazonaws.com/my-stack"
+	if got := aws.StringValue(fakeAPI.createInput.TemplateURL); got != expectedURL {
+		t.Errorf("expected CreateChangeSet to use TemplateURL '%s', got '%s'", expectedURL, got)
+	}
+}
+
+func TestPlanStackUsesInlineTemplateBodyWhenUnderLimit(t *testing.T) {
+	fakeAPI := &fakePlanCfnAPI{}
+	fakePackager := &fakePlanTemplatePackager{}
+	cfnMgr := &cloudformationStackManager{cfnAPI: fakeAPI, templatePackager: fakePackager, logger: NewNopLogger()}
+
+	smallBody := "Resources: {}"
+
+	if _, err := cfnMgr.PlanStack("my-stack", smallBody, nil); err != nil {
+		t.Fatalf("PlanStack returned error: %s", err)
+	}
+
+	if fakePackager.uploadedStack != "" {
+		t.Errorf("expected no template staging for a small template, but UploadTemplateBody was called for stack %q", fakePackager.uploadedStack)
+	}
+	if got := aws.StringValue(fakeAPI.createInput.TemplateBody); got != smallBody {
+		t.Errorf("expected CreateChangeSet to inline the template body, got '%s'", got)
+	}
+	if fakeAPI.createInput.TemplateURL != nil {
+		t.Errorf("expected TemplateURL to be unset for an inline template, got %q", aws.StringValue(fakeAPI.createInput.TemplateURL))
+	}
+}
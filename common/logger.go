@@ -0,0 +1,161 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// Fields are the stable, structured key/value pairs attached to every line a Logger emits, e.g.
+// "stack", "region", "operation", "requestID", "pipeline", "stage", "action"
+type Fields map[string]interface{}
+
+// Logger is the structured, context-aware logging interface used by StackManager and
+// PipelineManager in place of a package-scoped global. WithFields returns a derived Logger that
+// carries the given fields on every subsequent line, so callers can attach context
+// (stack/region/operation, or pipeline/stage/action) without threading it through every log call.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Notice(args ...interface{})
+	Noticef(format string, args ...interface{})
+	WithFields(fields Fields) Logger
+}
+
+type loggerContextKey struct{}
+
+// NewContext returns a context carrying logger, retrievable with LoggerFromContext
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext returns the Logger attached to ctx, or a no-op Logger if none was attached
+func LoggerFromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return logger
+	}
+	return NewNopLogger()
+}
+
+func mergeFields(base Fields, extra Fields) Fields {
+	merged := make(Fields, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (f Fields) String() string {
+	if len(f) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(f))
+	for k, v := range f {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(parts)
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// consoleLogger is a human-readable implementation of Logger backed by go-logging, preserving
+// the existing console output format
+type consoleLogger struct {
+	backend *logging.Logger
+	fields  Fields
+}
+
+// NewConsoleLogger creates a Logger that writes human-readable lines via go-logging
+func NewConsoleLogger(name string) Logger {
+	return &consoleLogger{backend: logging.MustGetLogger(name)}
+}
+
+func (l *consoleLogger) Debug(args ...interface{}) {
+	l.backend.Debug(append([]interface{}{l.fields.String()}, args...)...)
+}
+
+func (l *consoleLogger) Debugf(format string, args ...interface{}) {
+	l.backend.Debugf(l.fields.String()+format, args...)
+}
+
+func (l *consoleLogger) Notice(args ...interface{}) {
+	l.backend.Notice(append([]interface{}{l.fields.String()}, args...)...)
+}
+
+func (l *consoleLogger) Noticef(format string, args ...interface{}) {
+	l.backend.Noticef(l.fields.String()+format, args...)
+}
+
+func (l *consoleLogger) WithFields(fields Fields) Logger {
+	return &consoleLogger{backend: l.backend, fields: mergeFields(l.fields, fields)}
+}
+
+// jsonLogger is a structured implementation of Logger that writes one JSON object per line,
+// suitable for CloudWatch Logs ingestion
+type jsonLogger struct {
+	out    io.Writer
+	fields Fields
+}
+
+// NewJSONLogger creates a Logger that writes structured JSON lines to out
+func NewJSONLogger(out io.Writer) Logger {
+	return &jsonLogger{out: out}
+}
+
+func (l *jsonLogger) emit(level string, message string) {
+	entry := make(map[string]interface{}, len(l.fields)+2)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["level"] = level
+	entry["message"] = message
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(l.out, string(line))
+}
+
+func (l *jsonLogger) Debug(args ...interface{}) { l.emit("debug", fmt.Sprint(args...)) }
+func (l *jsonLogger) Debugf(format string, args ...interface{}) {
+	l.emit("debug", fmt.Sprintf(format, args...))
+}
+func (l *jsonLogger) Notice(args ...interface{}) { l.emit("notice", fmt.Sprint(args...)) }
+func (l *jsonLogger) Noticef(format string, args ...interface{}) {
+	l.emit("notice", fmt.Sprintf(format, args...))
+}
+
+func (l *jsonLogger) WithFields(fields Fields) Logger {
+	return &jsonLogger{out: l.out, fields: mergeFields(l.fields, fields)}
+}
+
+// nopLogger discards everything, for tests that shouldn't depend on log output
+type nopLogger struct{}
+
+// NewNopLogger creates a Logger that discards every line
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(args ...interface{})                  {}
+func (nopLogger) Debugf(format string, args ...interface{})  {}
+func (nopLogger) Notice(args ...interface{})                 {}
+func (nopLogger) Noticef(format string, args ...interface{}) {}
+func (nopLogger) WithFields(Fields) Logger                   { return nopLogger{} }
+
+// requestIDFields extracts the AWS request ID from err (when it's an awserr.RequestFailure) so
+// callers can attach it as a stable "requestID" field alongside stack/pipeline context
+func requestIDFields(err error) Fields {
+	if requestErr, ok := err.(interface{ RequestID() string }); ok {
+		return Fields{"requestID": requestErr.RequestID()}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// templateRefPattern matches local template artifacts that still need to be staged in S3:
+// a `TemplateURL: ./path` property of a nested AWS::CloudFormation::Stack, or a `!Include path`
+// reference. Already-remote references (s3://, http(s)://) are left alone.
+var templateRefPattern = regexp.MustCompile(`(?m)^(\s*TemplateURL:\s*)(\.\.?/\S+)\s*$|!Include\s+(\S+)`)
+
+// TemplatePackager uploads local template artifacts to S3 so they can be referenced by URL
+type TemplatePackager interface {
+	// PackageTemplate walks the template at templatePath, uploads any nested-stack or !Include
+	// artifacts it references locally to S3, and returns the rewritten template body with the
+	// artifacts' S3 URLs substituted in.
+	PackageTemplate(templatePath string) (string, error)
+
+	// UploadTemplateBody stages a template body in S3 and returns its URL, for use as a
+	// CloudFormation TemplateURL when the body is too large to pass inline.
+	UploadTemplateBody(stackName string, templateBody string) (string, error)
+}
+
+type s3TemplatePackager struct {
+	s3API  s3iface.S3API
+	bucket string
+	logger Logger
+}
+
+// newAccountTemplatePackager creates a TemplatePackager that stages artifacts in the
+// mu-templates-<account>-<region> bucket for the session's account
+func newAccountTemplatePackager(sess *session.Session, region string, logger Logger) (TemplatePackager, error) {
+	stsAPI := sts.New(sess, &aws.Config{Region: aws.String(region)})
+	identity, err := stsAPI.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := fmt.Sprintf("mu-templates-%s-%s", aws.StringValue(identity.Account), region)
+	logger.Debugf("  Using template staging bucket '%s'", bucket)
+
+	return &s3TemplatePackager{
+		s3API:  s3.New(sess, &aws.Config{Region: aws.String(region)}),
+		bucket: bucket,
+		logger: logger,
+	}, nil
+}
+
+// PackageTemplate walks the template at templatePath, uploads any nested-stack or !Include
+// artifacts it references locally to S3, and returns the rewritten template body
+func (pkg *s3TemplatePackager) PackageTemplate(templatePath string) (string, error) {
+	body, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return "", err
+	}
+
+	baseDir := filepath.Dir(templatePath)
+	matches := templateRefPattern.FindAllSubmatchIndex(body, -1)
+	if len(matches) == 0 {
+		return string(body), nil
+	}
+
+	var rewritten bytes.Buffer
+	lastEnd := 0
+	for _, match := range matches {
+		rewritten.Write(body[lastEnd:match[0]])
+
+		var prefix, localPath string
+		if match[2] != -1 {
+			prefix = string(body[match[2]:match[3]])
+			localPath = string(body[match[4]:match[5]])
+		} else {
+			localPath = string(body[match[6]:match[7]])
+		}
+
+		if strings.Contains(localPath, "://") {
+			rewritten.Write(body[match[0]:match[1]])
+			lastEnd = match[1]
+			continue
+		}
+
+		url, err := pkg.uploadArtifact(filepath.Join(baseDir, localPath))
+		if err != nil {
+			return "", err
+		}
+
+		if prefix != "" {
+			rewritten.WriteString(prefix)
+			rewritten.WriteString(url)
+		} else {
+			rewritten.WriteString("!Include " + url)
+		}
+		lastEnd = match[1]
+	}
+	rewritten.Write(body[lastEnd:])
+
+	return rewritten.String(), nil
+}
+
+// UploadTemplateBody stages a template body in S3 and returns its URL
+func (pkg *s3TemplatePackager) UploadTemplateBody(stackName string, templateBody string) (string, error) {
+	return pkg.upload(fmt.Sprintf("%s.template", stackName), []byte(templateBody))
+}
+
+func (pkg *s3TemplatePackager) uploadArtifact(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return pkg.upload(filepath.Base(path), data)
+}
+
+// upload stores data in the staging bucket under a content-hash key, so re-uploading identical
+// content is idempotent, and returns its https:// URL
+func (pkg *s3TemplatePackager) upload(name string, data []byte) (string, error) {
+	hash := sha256.Sum256(data)
+	key := fmt.Sprintf("%x/%s", hash, name)
+
+	pkg.logger.Debugf("  Uploading template artifact '%s' to s3://%s/%s", name, pkg.bucket, key)
+	_, err := pkg.s3API.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(pkg.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", pkg.bucket, key), nil
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3API records the objects PutObject was asked to store, so tests can assert on what
+// PackageTemplate staged without talking to real S3
+type fakeS3API struct {
+	s3iface.S3API
+	puts []*s3.PutObjectInput
+}
+
+func (f *fakeS3API) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestPackageTemplateRewritesNestedStackRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mu-packager-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nestedBody := "AWSTemplateFormatVersion: '2010-09-09'\nResources: {}\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "nested.yml"), []byte(nestedBody), 0644); err != nil {
+		t.Fatalf("failed to write nested template: %s", err)
+	}
+
+	mainBody := "Resources:\n  Nested:\n    Type: AWS::CloudFormation::Stack\n    Properties:\n      TemplateURL: ./nested.yml\n"
+	mainPath := filepath.Join(dir, "main.yml")
+	if err := ioutil.WriteFile(mainPath, []byte(mainBody), 0644); err != nil {
+		t.Fatalf("failed to write main template: %s", err)
+	}
+
+	fakeAPI := &fakeS3API{}
+	pkg := &s3TemplatePackager{s3API: fakeAPI, bucket: "testbucket", logger: NewNopLogger()}
+
+	rewritten, err := pkg.PackageTemplate(mainPath)
+	if err != nil {
+		t.Fatalf("PackageTemplate returned error: %s", err)
+	}
+
+	if len(fakeAPI.puts) != 1 {
+		t.Fatalf("expected 1 artifact to be staged in S3, got %d", len(fakeAPI.puts))
+	}
+	if got := aws.StringValue(fakeAPI.puts[0].Bucket); got != "testbucket" {
+		t.Errorf("expected artifact staged in bucket 'testbucket', got '%s'", got)
+	}
+	stagedBody, err := ioutil.ReadAll(fakeAPI.puts[0].Body)
+	if err != nil {
+		t.Fatalf("failed to read staged artifact body: %s", err)
+	}
+	if string(stagedBody) != nestedBody {
+		t.Errorf("expected staged artifact body to match nested.yml, got '%s'", string(stagedBody))
+	}
+
+	if strings.Contains(rewritten, "./nested.yml") {
+		t.Errorf("expected local TemplateURL reference to be rewritten, got:\n%s", rewritten)
+	}
+	expectedURL := "https://testbucket.s3.amazonaws.com/"
+	if !strings.Contains(rewritten, expectedURL) {
+		t.Errorf("expected rewritten template to reference '%s', got:\n%s", expectedURL, rewritten)
+	}
+}
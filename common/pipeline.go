@@ -1,7 +1,8 @@
 package common
 
 import (
-	"errors"
+	"context"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/codepipeline"
@@ -13,35 +14,84 @@ type PipelineStateLister interface {
 	ListState(pipelineName string) ([]*codepipeline.StageState, error)
 }
 
+// PipelineExecutionStarter for triggering a new execution of a pipeline
+type PipelineExecutionStarter interface {
+	StartPipelineExecution(pipelineName string) (executionID string, err error)
+}
+
+// PipelineExecutionStopper for halting an in-progress pipeline execution
+type PipelineExecutionStopper interface {
+	StopPipelineExecution(pipelineName string, executionID string, reason string) error
+}
+
+// StageExecutionRetrier for retrying the failed actions of a pipeline stage
+type StageExecutionRetrier interface {
+	RetryStageExecution(pipelineName string, stageName string, executionID string) error
+}
+
+// ApprovalResulter for approving or rejecting a manual-approval action
+type ApprovalResulter interface {
+	PutApprovalResult(pipelineName string, stageName string, actionName string, token string, approved bool, summary string) error
+}
+
+// PipelineExecution is a normalized view of one execution of a pipeline
+type PipelineExecution struct {
+	ExecutionID string
+	Status      string
+}
+
+// PipelineExecutionHistoryLister for listing past executions of a pipeline
+type PipelineExecutionHistoryLister interface {
+	GetPipelineExecutionHistory(pipelineName string, limit int64) ([]PipelineExecution, error)
+}
+
+// ExecutionRevisionLister for looking up the source revisions of a specific pipeline execution
+type ExecutionRevisionLister interface {
+	// GetExecutionRevisions returns the revision ID for every source artifact produced during
+	// the given pipeline execution, keyed by artifact name
+	GetExecutionRevisions(pipelineName string, executionID string) (map[string]string, error)
+}
+
 // PipelineManager composite of all cluster capabilities
 type PipelineManager interface {
 	PipelineStateLister
+	PipelineExecutionStarter
+	PipelineExecutionStopper
+	StageExecutionRetrier
+	ApprovalResulter
+	PipelineExecutionHistoryLister
+	ExecutionRevisionLister
 }
 
 type codePipelineManager struct {
 	codePipelineAPI codepipelineiface.CodePipelineAPI
+	logger          Logger
 }
 
-func newPipelineManager(sess *session.Session) (PipelineManager, error) {
-	log.Debug("Connecting to CodePipeline service")
+func newPipelineManager(ctx context.Context, sess *session.Session) (PipelineManager, error) {
+	logger := LoggerFromContext(ctx).WithFields(Fields{"operation": "pipeline"})
+	logger.Debug("Connecting to CodePipeline service")
 	codePipelineAPI := codepipeline.New(sess)
 
 	return &codePipelineManager{
 		codePipelineAPI: codePipelineAPI,
+		logger:          logger,
 	}, nil
 }
 
 // ListState get the state of the pipeline
 func (cplMgr *codePipelineManager) ListState(pipelineName string) ([]*codepipeline.StageState, error) {
 	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName})
 
 	params := &codepipeline.GetPipelineStateInput{
 		Name: aws.String(pipelineName),
 	}
 
-	log.Debugf("Searching for pipeline state for pipeline named '%s'", pipelineName)
+	logger.Debugf("Searching for pipeline state for pipeline named '%s'", pipelineName)
 
 	output, err := cplAPI.GetPipelineState(params)
+	logger.WithFields(requestIDFields(err)).Debugf("  Get pipeline state complete err=%s", err)
 	if err != nil {
 		return nil, err
 	}
@@ -49,25 +99,126 @@ func (cplMgr *codePipelineManager) ListState(pipelineName string) ([]*codepipeli
 	return output.StageStates, nil
 }
 
-func getRevisionFromCodePipeline(pipelineName string) (string, error) {
-	sess := session.Must(session.NewSession())
-	service := codepipeline.New(sess)
+// StartPipelineExecution starts a new execution of the pipeline
+func (cplMgr *codePipelineManager) StartPipelineExecution(pipelineName string) (string, error) {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName})
 
-	params := &codepipeline.GetPipelineStateInput{
+	logger.Debugf("Starting execution for pipeline '%s'", pipelineName)
+	output, err := cplAPI.StartPipelineExecution(&codepipeline.StartPipelineExecutionInput{
 		Name: aws.String(pipelineName),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Start pipeline execution complete err=%s", err)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.PipelineExecutionId), nil
+}
+
+// StopPipelineExecution stops an in-progress execution of the pipeline
+func (cplMgr *codePipelineManager) StopPipelineExecution(pipelineName string, executionID string, reason string) error {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName})
+
+	logger.Debugf("Stopping execution '%s' for pipeline '%s'", executionID, pipelineName)
+	_, err := cplAPI.StopPipelineExecution(&codepipeline.StopPipelineExecutionInput{
+		PipelineName:        aws.String(pipelineName),
+		PipelineExecutionId: aws.String(executionID),
+		Reason:              aws.String(reason),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Stop pipeline execution complete err=%s", err)
+	return err
+}
+
+// RetryStageExecution retries the failed actions of a stage within a pipeline execution
+func (cplMgr *codePipelineManager) RetryStageExecution(pipelineName string, stageName string, executionID string) error {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName, "stage": stageName})
+
+	logger.Debugf("Retrying stage '%s' for pipeline '%s' execution '%s'", stageName, pipelineName, executionID)
+	_, err := cplAPI.RetryStageExecution(&codepipeline.RetryStageExecutionInput{
+		PipelineName:        aws.String(pipelineName),
+		StageName:           aws.String(stageName),
+		PipelineExecutionId: aws.String(executionID),
+		RetryMode:           aws.String(codepipeline.StageRetryModeFailedActions),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Retry stage execution complete err=%s", err)
+	return err
+}
+
+// PutApprovalResult approves or rejects a manual-approval action
+func (cplMgr *codePipelineManager) PutApprovalResult(pipelineName string, stageName string, actionName string, token string, approved bool, summary string) error {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName, "stage": stageName, "action": actionName})
+
+	status := codepipeline.ApprovalStatusApproved
+	if !approved {
+		status = codepipeline.ApprovalStatusRejected
 	}
-	response, err := service.GetPipelineState(params)
 
+	logger.Debugf("Submitting '%s' approval result for pipeline '%s' stage '%s' action '%s'", status, pipelineName, stageName, actionName)
+	_, err := cplAPI.PutApprovalResult(&codepipeline.PutApprovalResultInput{
+		PipelineName: aws.String(pipelineName),
+		StageName:    aws.String(stageName),
+		ActionName:   aws.String(actionName),
+		Token:        aws.String(token),
+		Result: &codepipeline.ApprovalResult{
+			Status:  aws.String(status),
+			Summary: aws.String(summary),
+		},
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Put approval result complete err=%s", err)
+	return err
+}
+
+// GetPipelineExecutionHistory returns the most recent executions of the pipeline, newest first
+func (cplMgr *codePipelineManager) GetPipelineExecutionHistory(pipelineName string, limit int64) ([]PipelineExecution, error) {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName})
+
+	logger.Debugf("Listing execution history for pipeline '%s'", pipelineName)
+	output, err := cplAPI.ListPipelineExecutions(&codepipeline.ListPipelineExecutionsInput{
+		PipelineName: aws.String(pipelineName),
+		MaxResults:   aws.Int64(limit),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  List pipeline executions complete err=%s", err)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	executions := make([]PipelineExecution, 0, len(output.PipelineExecutionSummaries))
+	for _, summary := range output.PipelineExecutionSummaries {
+		executions = append(executions, PipelineExecution{
+			ExecutionID: aws.StringValue(summary.PipelineExecutionId),
+			Status:      aws.StringValue(summary.Status),
+		})
+	}
+
+	return executions, nil
+}
+
+// GetExecutionRevisions returns the revision ID for every source artifact produced during the
+// given pipeline execution, keyed by artifact name. This generalizes the old single-"Source"-
+// action, current-revision-only lookup to any execution and any number of source actions.
+func (cplMgr *codePipelineManager) GetExecutionRevisions(pipelineName string, executionID string) (map[string]string, error) {
+	cplAPI := cplMgr.codePipelineAPI
+	logger := cplMgr.logger.WithFields(Fields{"pipeline": pipelineName})
+
+	logger.Debugf("Looking up source revisions for pipeline '%s' execution '%s'", pipelineName, executionID)
+	output, err := cplAPI.GetPipelineExecution(&codepipeline.GetPipelineExecutionInput{
+		PipelineName:        aws.String(pipelineName),
+		PipelineExecutionId: aws.String(executionID),
+	})
+	logger.WithFields(requestIDFields(err)).Debugf("  Get pipeline execution complete err=%s", err)
+	if err != nil {
+		return nil, err
 	}
-	for _, stageState := range response.StageStates {
-		for _, actionState := range stageState.ActionStates {
-			if *actionState.ActionName == "Source" {
-				return *actionState.CurrentRevision.RevisionId, nil
-			}
-		}
+
+	revisions := make(map[string]string)
+	for _, artifact := range output.PipelineExecution.ArtifactRevisions {
+		revisions[aws.StringValue(artifact.Name)] = aws.StringValue(artifact.RevisionId)
 	}
 
-	return "", errors.New("Can not locate revision from CodePipeline: " + pipelineName)
+	return revisions, nil
 }
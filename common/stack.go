@@ -1,51 +1,150 @@
 package common
 
 import (
-	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
-	"github.com/op/go-logging"
-	"io"
 )
 
-var log = logging.MustGetLogger("stack")
+// stackPollInterval is how often AwaitFinalStatus re-checks stack status while pending
+const stackPollInterval = 2 * time.Second
+
+// stackPendingStatuses are statuses that mean the stack is still changing
+var stackPendingStatuses = map[string]bool{
+	cloudformation.StackStatusReviewInProgress:                        true,
+	cloudformation.StackStatusCreateInProgress:                        true,
+	cloudformation.StackStatusRollbackInProgress:                      true,
+	cloudformation.StackStatusDeleteInProgress:                        true,
+	cloudformation.StackStatusUpdateInProgress:                        true,
+	cloudformation.StackStatusUpdateCompleteCleanupInProgress:         true,
+	cloudformation.StackStatusUpdateRollbackInProgress:                true,
+	cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress: true,
+}
+
+// stackFailureStatuses are terminal statuses that indicate the stack operation failed
+var stackFailureStatuses = map[string]bool{
+	cloudformation.StackStatusCreateFailed:           true,
+	cloudformation.StackStatusRollbackFailed:         true,
+	cloudformation.StackStatusRollbackComplete:       true,
+	cloudformation.StackStatusDeleteFailed:           true,
+	cloudformation.StackStatusUpdateRollbackFailed:   true,
+	cloudformation.StackStatusUpdateRollbackComplete: true,
+}
+
+// resourceFailureStatuses are the per-resource statuses worth surfacing in a StackFailureError
+var resourceFailureStatuses = map[string]bool{
+	cloudformation.ResourceStatusCreateFailed: true,
+	cloudformation.ResourceStatusDeleteFailed: true,
+	cloudformation.ResourceStatusUpdateFailed: true,
+}
+
+// StackEvent is a single CloudFormation stack event, as streamed by AwaitFinalStatus
+type StackEvent struct {
+	EventID              string
+	LogicalResourceID    string
+	ResourceType         string
+	ResourceStatus       string
+	ResourceStatusReason string
+	Timestamp            time.Time
+}
+
+// StackFailureError describes a stack operation that ended in a failure status,
+// including the resource events that caused it
+type StackFailureError struct {
+	StackName       string
+	Status          string
+	FailedResources []StackEvent
+}
+
+func (e *StackFailureError) Error() string {
+	if len(e.FailedResources) == 0 {
+		return fmt.Sprintf("stack '%s' ended in status %s", e.StackName, e.Status)
+	}
+	reasons := make([]string, 0, len(e.FailedResources))
+	for _, resource := range e.FailedResources {
+		reasons = append(reasons, fmt.Sprintf("%s (%s): %s", resource.LogicalResourceID, resource.ResourceStatus, resource.ResourceStatusReason))
+	}
+	return fmt.Sprintf("stack '%s' ended in status %s: %s", e.StackName, e.Status, strings.Join(reasons, "; "))
+}
 
 // StackWaiter for waiting on stack status to be final
 type StackWaiter interface {
-	AwaitFinalStatus(stackName string) string
+	// AwaitFinalStatus waits for the stack to arrive in a final status, streaming stack events
+	// to the (optional) events channel as they are observed. Returns the final status, or empty
+	// string if the stack doesn't exist. Returns a *StackFailureError if the final status is a
+	// failure status.
+	AwaitFinalStatus(stackName string, events chan<- StackEvent) (string, error)
 }
 
 // StackUpserter for applying changes to a stack
 type StackUpserter interface {
-	UpsertStack(stackName string, templateBodyReader io.Reader, stackParameters map[string]string) error
+	// UpsertStack creates/updates the stack from the template at templatePath. templatePath is
+	// also used to resolve any nested-stack/!Include references the template makes to local
+	// artifacts (see TemplatePackager), so it must be a path on disk rather than an arbitrary
+	// reader.
+	UpsertStack(stackName string, templatePath string, stackParameters map[string]string, dryRun bool) error
+}
+
+// TemplateValidator for pre-flight validation of a template before create/update. Exactly one of
+// templateBody/templateURL should be set, mirroring the TemplateBody/TemplateURL pair CloudFormation
+// itself accepts, so validation exercises the same source the stack operation will use.
+type TemplateValidator interface {
+	ValidateTemplate(templateBody *string, templateURL *string) error
+}
+
+// StackDestroyer for removing a stack entirely
+type StackDestroyer interface {
+	DestroyStack(stackName string) error
 }
 
 // StackManager composite of all stack capabilities
 type StackManager interface {
 	StackUpserter
 	StackWaiter
+	ChangeSetPlanner
+	ChangeSetApplier
+	DriftDetector
+	TemplateValidator
+	StackDestroyer
 }
 
 type cloudformationStackManager struct {
-	cfnAPI cloudformationiface.CloudFormationAPI
+	cfnAPI           cloudformationiface.CloudFormationAPI
+	templatePackager TemplatePackager
+	logger           Logger
 }
 
-// TODO: support "dry-run" and write the template to a file
-// fmt.Sprintf("%s/%s.yml", os.TempDir(), name),
+// newStackManager creates a new StackManager backed by cloudformation. The Logger attached to
+// ctx (see NewContext) is used for every operation, scoped with "region" and "operation" fields.
+func newStackManager(ctx context.Context, region string) (StackManager, error) {
+	logger := LoggerFromContext(ctx).WithFields(Fields{"region": region, "operation": "stack"})
 
-// NewStackManager creates a new StackManager backed by cloudformation
-func newStackManager(region string) (StackManager, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("Connecting to CloudFormation service in region:%s", region)
+	logger.Debugf("Connecting to CloudFormation service in region:%s", region)
 	cfn := cloudformation.New(sess, &aws.Config{Region: aws.String(region)})
+
+	templatePackager, err := newAccountTemplatePackager(sess, region, logger)
+	if err != nil {
+		// template packaging is only needed for large/nested templates - don't fail
+		// stack manager construction over it
+		logger.Debugf("  Template packager unavailable, large templates will fail: %s", err)
+	}
+
 	return &cloudformationStackManager{
-		cfnAPI: cfn,
+		cfnAPI:           cfn,
+		templatePackager: templatePackager,
+		logger:           logger,
 	}, nil
 }
 
@@ -61,22 +160,53 @@ func buildStackParameters(stackParameters map[string]string) []*cloudformation.P
 	return parameters
 }
 
+// loadTemplate reads the template at templatePath, staging any nested-stack/!Include artifacts it
+// references locally in S3 and rewriting the template to point at them (see TemplatePackager). If
+// no template packager is configured, the template is read as-is and local references are left
+// untouched.
+func (cfnMgr *cloudformationStackManager) loadTemplate(templatePath string) (string, error) {
+	if cfnMgr.templatePackager != nil {
+		return cfnMgr.templatePackager.PackageTemplate(templatePath)
+	}
+
+	body, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 // UpsertStack will create/update the cloudformation stack
-func (cfnMgr *cloudformationStackManager) UpsertStack(stackName string, templateBodyReader io.Reader, stackParameters map[string]string) error {
-	stackStatus := cfnMgr.AwaitFinalStatus(stackName)
+func (cfnMgr *cloudformationStackManager) UpsertStack(stackName string, templatePath string, stackParameters map[string]string, dryRun bool) error {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName})
+
+	rawTemplateBody, err := cfnMgr.loadTemplate(templatePath)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return cfnMgr.planAndDump(stackName, rawTemplateBody, stackParameters)
+	}
+
+	stackStatus, _ := cfnMgr.AwaitFinalStatus(stackName, nil)
+
+	templateBody, templateURL, err := cfnMgr.resolveTemplateSource(stackName, rawTemplateBody)
+	if err != nil {
+		return err
+	}
 
-	// load the template
-	templateBodyBytes := new(bytes.Buffer)
-	templateBodyBytes.ReadFrom(templateBodyReader)
-	templateBody := aws.String(templateBodyBytes.String())
+	if err := cfnMgr.ValidateTemplate(templateBody, templateURL); err != nil {
+		return err
+	}
 
 	parameters := buildStackParameters(stackParameters)
 
 	cfnAPI := cfnMgr.cfnAPI
 	if stackStatus == "" {
 
-		log.Debugf("  Creating stack named '%s'", stackName)
-		log.Debugf("  Stack parameters:\n\t%s", parameters)
+		logger.Debugf("  Creating stack named '%s'", stackName)
+		logger.Debugf("  Stack parameters:\n\t%s", parameters)
 		params := &cloudformation.CreateStackInput{
 			StackName: aws.String(stackName),
 			Capabilities: []*string{
@@ -84,24 +214,23 @@ func (cfnMgr *cloudformationStackManager) UpsertStack(stackName string, template
 			},
 			Parameters:   parameters,
 			TemplateBody: templateBody,
+			TemplateURL:  templateURL,
 		}
 		_, err := cfnAPI.CreateStack(params)
-		log.Debug("  Create stack complete err=%s", err)
+		logger.WithFields(requestIDFields(err)).Debug("  Create stack complete err=%s", err)
 		if err != nil {
 			return err
 		}
 
-		waitParams := &cloudformation.DescribeStacksInput{
-			StackName: aws.String(stackName),
+		logger.Debug("  Waiting for stack create to complete...")
+		if _, err := cfnMgr.AwaitFinalStatus(stackName, nil); err != nil {
+			return err
 		}
-		log.Debug("  Waiting for stack to exist...")
-		cfnAPI.WaitUntilStackExists(waitParams)
-		log.Debug("  Stack exists.")
 
 	} else {
-		log.Debugf("  Updating stack named '%s'", stackName)
-		log.Debugf("  Prior state: %s", stackStatus)
-		log.Debugf("  Stack parameters:\n\t%s", parameters)
+		logger.Debugf("  Updating stack named '%s'", stackName)
+		logger.Debugf("  Prior state: %s", stackStatus)
+		logger.Debugf("  Stack parameters:\n\t%s", parameters)
 		params := &cloudformation.UpdateStackInput{
 			StackName: aws.String(stackName),
 			Capabilities: []*string{
@@ -109,71 +238,165 @@ func (cfnMgr *cloudformationStackManager) UpsertStack(stackName string, template
 			},
 			Parameters:   parameters,
 			TemplateBody: templateBody,
+			TemplateURL:  templateURL,
 		}
 
 		_, err := cfnAPI.UpdateStack(params)
-		log.Debug("  Update stack complete err=%s", err)
+		logger.WithFields(requestIDFields(err)).Debug("  Update stack complete err=%s", err)
 		if err != nil {
 			if awsErr, ok := err.(awserr.Error); ok {
 				if awsErr.Code() == "ValidationError" && awsErr.Message() == "No updates are to be performed." {
-					log.Noticef("  No changes for stack '%s'", stackName)
+					logger.Noticef("  No changes for stack '%s'", stackName)
 					return nil
 				}
 			}
 			return err
 		}
 
+		logger.Debug("  Waiting for stack update to complete...")
+		if _, err := cfnMgr.AwaitFinalStatus(stackName, nil); err != nil {
+			return err
+		}
+
 	}
 	return nil
 }
 
-// AwaitFinalStatus waits for the stack to arrive in a final status
-//  returns: final status, or empty string if stack doesn't exist
-func (cfnMgr *cloudformationStackManager) AwaitFinalStatus(stackName string) string {
-	cfnAPI := cfnMgr.cfnAPI
-	params := &cloudformation.DescribeStacksInput{
+// maxInlineTemplateSize is the largest template CloudFormation accepts as an inline TemplateBody;
+// larger templates must be staged in S3 and referenced via TemplateURL
+const maxInlineTemplateSize = 51200
+
+// ValidateTemplate checks the template is well-formed before it is used for a create/update.
+// Exactly one of templateBody/templateURL is expected to be set - pass whichever
+// resolveTemplateSource returned, so a template over the inline size limit is validated via its
+// staged TemplateURL rather than being rejected before it gets a chance to use it.
+func (cfnMgr *cloudformationStackManager) ValidateTemplate(templateBody *string, templateURL *string) error {
+	cfnMgr.logger.Debug("  Validating template...")
+	_, err := cfnMgr.cfnAPI.ValidateTemplate(&cloudformation.ValidateTemplateInput{
+		TemplateBody: templateBody,
+		TemplateURL:  templateURL,
+	})
+	return err
+}
+
+// resolveTemplateSource decides whether the template can be passed inline, or whether it must be
+// staged in S3 and referenced via TemplateURL because it exceeds maxInlineTemplateSize
+func (cfnMgr *cloudformationStackManager) resolveTemplateSource(stackName string, templateBody string) (*string, *string, error) {
+	if len(templateBody) <= maxInlineTemplateSize {
+		return aws.String(templateBody), nil, nil
+	}
+
+	if cfnMgr.templatePackager == nil {
+		return nil, nil, fmt.Errorf("template for stack '%s' is %d bytes, exceeding the %d byte inline limit, but no template staging bucket is configured", stackName, len(templateBody), maxInlineTemplateSize)
+	}
+
+	cfnMgr.logger.Debugf("  Template for stack '%s' is %d bytes, staging in S3 to use TemplateURL", stackName, len(templateBody))
+	url, err := cfnMgr.templatePackager.UploadTemplateBody(stackName, templateBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, aws.String(url), nil
+}
+
+// DestroyStack deletes the stack and waits for the deletion to complete
+func (cfnMgr *cloudformationStackManager) DestroyStack(stackName string) error {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName})
+
+	logger.Debugf("  Deleting stack named '%s'", stackName)
+	_, err := cfnMgr.cfnAPI.DeleteStack(&cloudformation.DeleteStackInput{
 		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return err
 	}
-	resp, err := cfnAPI.DescribeStacks(params)
-
-	if err == nil && resp != nil && len(resp.Stacks) == 1 {
-		switch *resp.Stacks[0].StackStatus {
-		case cloudformation.StackStatusReviewInProgress,
-			cloudformation.StackStatusCreateInProgress,
-			cloudformation.StackStatusRollbackInProgress:
-			// wait for create
-			log.Debugf("  Waiting for stack:%s to complete...current status=%s", stackName, *resp.Stacks[0].StackStatus)
-			cfnAPI.WaitUntilStackCreateComplete(params)
-			resp, err = cfnAPI.DescribeStacks(params)
-		case cloudformation.StackStatusDeleteInProgress:
-			// wait for delete
-			log.Debugf("  Waiting for stack:%s to delete...current status=%s", stackName, *resp.Stacks[0].StackStatus)
-			cfnAPI.WaitUntilStackDeleteComplete(params)
-			resp, err = cfnAPI.DescribeStacks(params)
-		case cloudformation.StackStatusUpdateInProgress,
-			cloudformation.StackStatusUpdateRollbackInProgress,
-			cloudformation.StackStatusUpdateCompleteCleanupInProgress,
-			cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress:
-			// wait for update
-			log.Debugf("  Waiting for stack:%s to update...current status=%s", stackName, *resp.Stacks[0].StackStatus)
-			cfnAPI.WaitUntilStackUpdateComplete(params)
-			resp, err = cfnAPI.DescribeStacks(params)
-		case cloudformation.StackStatusCreateFailed,
-			cloudformation.StackStatusCreateComplete,
-			cloudformation.StackStatusRollbackFailed,
-			cloudformation.StackStatusRollbackComplete,
-			cloudformation.StackStatusDeleteFailed,
-			cloudformation.StackStatusDeleteComplete,
-			cloudformation.StackStatusUpdateComplete,
-			cloudformation.StackStatusUpdateRollbackFailed,
-			cloudformation.StackStatusUpdateRollbackComplete:
-			// no op
 
+	logger.Debug("  Waiting for stack delete to complete...")
+	_, err = cfnMgr.AwaitFinalStatus(stackName, nil)
+	return err
+}
+
+// AwaitFinalStatus waits for the stack to arrive in a final status, streaming stack events to
+// the events channel (if non-nil) as they are observed, and closing it once the stack settles.
+// Returns the final status, or empty string if the stack doesn't exist. If the final status is
+// a failure status, the returned error is a *StackFailureError describing which resource(s)
+// failed and why.
+func (cfnMgr *cloudformationStackManager) AwaitFinalStatus(stackName string, events chan<- StackEvent) (string, error) {
+	logger := cfnMgr.logger.WithFields(Fields{"stack": stackName, "operation": "await-status"})
+	cfnAPI := cfnMgr.cfnAPI
+	seenEvents := make(map[string]bool)
+	// track the stack's own ID once known, so a delete-then-recreate of the same name
+	// can't cause us to keep polling the new stack's events under the old identity
+	stackID := stackName
+
+	var status string
+	var failures []StackEvent
+
+	for {
+		resp, err := cfnAPI.DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(stackID),
+		})
+		if err != nil || resp == nil || len(resp.Stacks) != 1 {
+			logger.Debugf("  Stack doesn't exist ... stack=%s", stackName)
+			if events != nil {
+				close(events)
+			}
+			return "", nil
+		}
+
+		stack := resp.Stacks[0]
+		stackID = aws.StringValue(stack.StackId)
+		status = aws.StringValue(stack.StackStatus)
+
+		eventsOutput, err := cfnAPI.DescribeStackEvents(&cloudformation.DescribeStackEventsInput{
+			StackName: aws.String(stackID),
+		})
+		if err != nil {
+			logger.Debugf("  Unable to describe stack events for stack:%s ... err=%s", stackName, err)
+		} else {
+			// events are returned newest-first; walk backwards to emit them in order
+			for i := len(eventsOutput.StackEvents) - 1; i >= 0; i-- {
+				event := eventsOutput.StackEvents[i]
+				eventID := aws.StringValue(event.EventId)
+				if seenEvents[eventID] {
+					continue
+				}
+				seenEvents[eventID] = true
+
+				stackEvent := StackEvent{
+					EventID:              eventID,
+					LogicalResourceID:    aws.StringValue(event.LogicalResourceId),
+					ResourceType:         aws.StringValue(event.ResourceType),
+					ResourceStatus:       aws.StringValue(event.ResourceStatus),
+					ResourceStatusReason: aws.StringValue(event.ResourceStatusReason),
+					Timestamp:            aws.TimeValue(event.Timestamp),
+				}
+				logger.Debugf("  %s %s %s: %s", stackEvent.ResourceType, stackEvent.LogicalResourceID, stackEvent.ResourceStatus, stackEvent.ResourceStatusReason)
+				if events != nil {
+					events <- stackEvent
+				}
+				if resourceFailureStatuses[stackEvent.ResourceStatus] {
+					failures = append(failures, stackEvent)
+				}
+			}
 		}
-		log.Debugf("  Returning final status for stack:%s ... status=%s", stackName, *resp.Stacks[0].StackStatus)
-		return *resp.Stacks[0].StackStatus
+
+		if !stackPendingStatuses[status] {
+			break
+		}
+
+		logger.Debugf("  Waiting for stack:%s to complete...current status=%s", stackName, status)
+		time.Sleep(stackPollInterval)
+	}
+
+	if events != nil {
+		close(events)
+	}
+
+	logger.Debugf("  Returning final status for stack:%s ... status=%s", stackName, status)
+
+	if stackFailureStatuses[status] {
+		return status, &StackFailureError{StackName: stackName, Status: status, FailedResources: failures}
 	}
 
-	log.Debugf("  Stack doesn't exist ... stack=%s", stackName)
-	return ""
+	return status, nil
 }
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// fakeCfnAPI drives AwaitFinalStatus through a scripted sequence of DescribeStacks responses,
+// one per call, so its poll loop can be exercised without a real stack. Each pending status
+// still waits out stackPollInterval before the next poll.
+type fakeCfnAPI struct {
+	cloudformationiface.CloudFormationAPI
+	statuses []string
+	call     int
+}
+
+func (f *fakeCfnAPI) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	if f.call >= len(f.statuses) {
+		f.call++
+		return nil, errors.New("stack does not exist")
+	}
+	status := f.statuses[f.call]
+	f.call++
+	return &cloudformation.DescribeStacksOutput{
+		Stacks: []*cloudformation.Stack{
+			{StackId: aws.String("stack-id"), StackStatus: aws.String(status)},
+		},
+	}, nil
+}
+
+func (f *fakeCfnAPI) DescribeStackEvents(input *cloudformation.DescribeStackEventsInput) (*cloudformation.DescribeStackEventsOutput, error) {
+	return &cloudformation.DescribeStackEventsOutput{}, nil
+}
+
+func TestAwaitFinalStatusReturnsOnceTerminal(t *testing.T) {
+	fakeAPI := &fakeCfnAPI{statuses: []string{
+		cloudformation.StackStatusCreateInProgress,
+		cloudformation.StackStatusCreateInProgress,
+		cloudformation.StackStatusCreateComplete,
+	}}
+	cfnMgr := &cloudformationStackManager{cfnAPI: fakeAPI, logger: NewNopLogger()}
+
+	status, err := cfnMgr.AwaitFinalStatus("my-stack", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if status != cloudformation.StackStatusCreateComplete {
+		t.Errorf("expected final status %s, got %s", cloudformation.StackStatusCreateComplete, status)
+	}
+	if fakeAPI.call != 3 {
+		t.Errorf("expected AwaitFinalStatus to poll 3 times, got %d", fakeAPI.call)
+	}
+}
+
+func TestAwaitFinalStatusReturnsStackFailureErrorOnFailureStatus(t *testing.T) {
+	fakeAPI := &fakeCfnAPI{statuses: []string{cloudformation.StackStatusRollbackComplete}}
+	cfnMgr := &cloudformationStackManager{cfnAPI: fakeAPI, logger: NewNopLogger()}
+
+	status, err := cfnMgr.AwaitFinalStatus("my-stack", nil)
+	if status != cloudformation.StackStatusRollbackComplete {
+		t.Errorf("expected final status %s, got %s", cloudformation.StackStatusRollbackComplete, status)
+	}
+	if _, ok := err.(*StackFailureError); !ok {
+		t.Fatalf("expected a *StackFailureError, got %T (%s)", err, err)
+	}
+}
+
+func TestAwaitFinalStatusReturnsEmptyStatusWhenStackDoesNotExist(t *testing.T) {
+	fakeAPI := &fakeCfnAPI{}
+	cfnMgr := &cloudformationStackManager{cfnAPI: fakeAPI, logger: NewNopLogger()}
+
+	status, err := cfnMgr.AwaitFinalStatus("my-stack", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if status != "" {
+		t.Errorf("expected empty status for a nonexistent stack, got %q", status)
+	}
+}